@@ -42,6 +42,7 @@ import (
 	computebeta "google.golang.org/api/compute/v0.beta"
 	compute "google.golang.org/api/compute/v1"
 	container "google.golang.org/api/container/v1"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
 )
 
 const (
@@ -87,7 +88,11 @@ type GCECloud struct {
 	serviceBeta      *computebeta.Service
 	containerService *container.Service
 	cloudkmsService  *cloudkms.Service
-	clientBuilder    controller.ControllerClientBuilder
+	cloudsqlService  *sqladmin.Service
+	// cloudSQLCache memoizes ResolveCloudSQLInstance lookups (including
+	// negative results) for cloudSQLCacheTTL.
+	cloudSQLCache map[string]cloudSQLCacheEntry
+	clientBuilder controller.ControllerClientBuilder
 	projectID        string
 	region           string
 	localZone        string   // The zone in which we are running
@@ -106,6 +111,15 @@ type GCECloud struct {
 	useMetadataServer        bool
 	operationPollRateLimiter flowcontrol.RateLimiter
 	manager                  ServiceManager
+	// zoneLister refreshes managedZones on a TTL for multizone clusters; nil
+	// when managedZones was pinned explicitly (e.g. single-zone clusters).
+	zoneLister *ZoneLister
+	// tokenSource is the RefreshingTokenSource backing service/serviceBeta/etc,
+	// kept around so its health can be surfaced via Healthy().
+	tokenSource *RefreshingTokenSource
+	// metricsSink exports operation latency/error metrics to Stackdriver when
+	// configured via Config.Global.MonitoringProject; nil (a no-op) otherwise.
+	metricsSink *StackdriverMetricsSink
 	// sharedResourceLock is used to serialize GCE operations that may mutate shared state to
 	// prevent inconsistencies. For example, load balancers manipulation methods will take the
 	// lock to prevent shared resources from being prematurely deleted while the operation is
@@ -145,6 +159,24 @@ type Config struct {
 		NodeInstancePrefix string   `gcfg:"node-instance-prefix"`
 		Multizone          bool     `gcfg:"multizone"`
 		ApiEndpoint        string   `gcfg:"api-endpoint"`
+		// LocalZone and ProjectID above are used as a fallback for project/zone discovery
+		// when the metadata server is unreachable and a service-account key file is
+		// set, e.g. when running control plane components off-cluster.
+		LocalZone string `gcfg:"local-zone"`
+		// ServiceAccountJSONKeyFile, if set, authenticates with GCE using the
+		// given Google service-account JSON key file instead of the metadata
+		// server's default compute token source. This is also settable via the
+		// GCE_SERVICE_ACCOUNT_JSON environment variable.
+		ServiceAccountJSONKeyFile string `gcfg:"service-account-key-file"`
+		// ServiceAccountScopes is the list of OAuth scopes requested for the
+		// token minted from ServiceAccountJSONKeyFile. Defaults to
+		// compute.CloudPlatformScope when empty.
+		ServiceAccountScopes []string `gcfg:"service-account-scopes"`
+		// MonitoringProject, if set together with MonitoringEnabled, is the
+		// GCP project that cloudprovider operation metrics (op_latency_seconds,
+		// op_errors_total, api_quota_consumed) are exported to via Stackdriver.
+		MonitoringProject string `gcfg:"monitoring-project"`
+		MonitoringEnabled bool   `gcfg:"monitoring-enabled"`
 	}
 }
 
@@ -166,14 +198,43 @@ func (g *GCECloud) GetKMSService() *cloudkms.Service {
 	return g.cloudkmsService
 }
 
+// Raw access to the cloudsqlService of GCE cloud. Used by ResolveCloudSQLInstance.
+func (g *GCECloud) GetCloudSQLService() *sqladmin.Service {
+	return g.cloudsqlService
+}
+
 // newGCECloud creates a new instance of GCECloud.
 func newGCECloud(config io.Reader) (*GCECloud, error) {
 	apiEndpoint := ""
 
+	var cfg Config
+	if config != nil {
+		if err := gcfg.ReadInto(&cfg, config); err != nil {
+			glog.Errorf("Couldn't read config: %v", err)
+			return nil, err
+		}
+		glog.Infof("Using GCE provider config %+v", cfg)
+	}
+
+	keyFile := cfg.Global.ServiceAccountJSONKeyFile
+	if keyFile == "" {
+		keyFile = serviceAccountKeyFileFromEnv()
+	}
+
 	// projectNumber is the numeric identifier. Note: there is also a unique string-based project identifier as well (see https://cloud.google.com/resource-manager/docs/creating-managing-projects#identifying_projects)
 	projectNumber, zone, err := getProjectAndZone()
 	if err != nil {
-		return nil, err
+		if keyFile == "" {
+			return nil, err
+		}
+		// Off-cluster control planes (e.g. a bastion host) running with a
+		// service-account key file have no metadata server to fall back on;
+		// require the project/zone to come from the config file instead.
+		glog.Warningf("Metadata server unavailable (%v); falling back to config for project/zone", err)
+		if cfg.Global.ProjectID == "" || cfg.Global.LocalZone == "" {
+			return nil, fmt.Errorf("no metadata server available and project-id/local-zone not set in cloud config")
+		}
+		projectNumber, zone = cfg.Global.ProjectID, cfg.Global.LocalZone
 	}
 	// Default projectID to known project number
 	projectID := projectNumber
@@ -186,7 +247,19 @@ func newGCECloud(config io.Reader) (*GCECloud, error) {
 	// networkProjectNumber is a numeric identifier similar to the projectNumber above.
 	networkProjectNumber, networkName, err := getNetworkProjectAndNameViaMetadata()
 	if err != nil {
-		return nil, err
+		if keyFile == "" {
+			return nil, err
+		}
+		// As above, an off-cluster control plane has no metadata server to
+		// resolve the cluster's network from; fall back to the config file,
+		// defaulting to the cluster's own project if network-project-id
+		// wasn't set (the common non-XPN case).
+		glog.Warningf("Metadata server unavailable (%v); falling back to config for network project/name", err)
+		networkProjectNumber = cfg.Global.NetworkProjectID
+		if networkProjectNumber == "" {
+			networkProjectNumber = projectID
+		}
+		networkName = cfg.Global.NetworkName
 	}
 	// Default networkProjectID to known network project number
 	networkProjectID := networkProjectNumber
@@ -201,12 +274,6 @@ func newGCECloud(config io.Reader) (*GCECloud, error) {
 	var nodeTags []string
 	var nodeInstancePrefix string
 	if config != nil {
-		var cfg Config
-		if err := gcfg.ReadInto(&cfg, config); err != nil {
-			glog.Errorf("Couldn't read config: %v", err)
-			return nil, err
-		}
-		glog.Infof("Using GCE provider config %+v", cfg)
 		if cfg.Global.ApiEndpoint != "" {
 			apiEndpoint = cfg.Global.ApiEndpoint
 		}
@@ -238,7 +305,23 @@ func newGCECloud(config io.Reader) (*GCECloud, error) {
 			}
 		}
 
-		if cfg.Global.TokenURL != "" {
+		var externalTokenSource oauth2.TokenSource
+		if ExternalTokenSourceProvider != nil {
+			externalTokenSource, err = ExternalTokenSourceProvider(&cfg)
+			if err != nil {
+				return nil, fmt.Errorf("ExternalTokenSourceProvider failed: %v", err)
+			}
+		}
+		if externalTokenSource != nil {
+			tokenSource = externalTokenSource
+		} else if keyFile != "" {
+			jwtTokenSource, err := serviceAccountTokenSource(keyFile, cfg.Global.ServiceAccountScopes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load service-account-key-file %q: %v", keyFile, err)
+			}
+			glog.Infof("Using JWT service-account credentials from %q", keyFile)
+			tokenSource = jwtTokenSource
+		} else if cfg.Global.TokenURL != "" {
 			tokenSource = NewAltTokenSource(cfg.Global.TokenURL, cfg.Global.TokenBody)
 		}
 		nodeTags = cfg.Global.NodeTags
@@ -248,21 +331,55 @@ func newGCECloud(config io.Reader) (*GCECloud, error) {
 		}
 	}
 
+	monitoringProject := ""
+	if cfg.Global.MonitoringEnabled {
+		monitoringProject = cfg.Global.MonitoringProject
+	}
+
 	return CreateGCECloud(apiEndpoint, projectID, networkProjectID, region, zone, managedZones, networkURL, subnetworkURL,
-		nodeTags, nodeInstancePrefix, tokenSource, true /* useMetadataServer */)
+		nodeTags, nodeInstancePrefix, tokenSource, true /* useMetadataServer */, monitoringProject)
 }
 
 // Creates a GCECloud object using the specified parameters.
 // If no networkUrl is specified, loads networkName via rest call.
 // If no tokenSource is specified, uses oauth2.DefaultTokenSource.
 // If managedZones is nil / empty all zones in the region will be managed.
+// If monitoringProject is non-empty, cloudprovider operation metrics are
+// exported to Stackdriver in that project (see StackdriverMetricsSink).
 func CreateGCECloud(apiEndpoint, projectID, networkProjectID, region, zone string, managedZones []string, networkURL, subnetworkURL string, nodeTags []string,
-	nodeInstancePrefix string, tokenSource oauth2.TokenSource, useMetadataServer bool) (*GCECloud, error) {
+	nodeInstancePrefix string, tokenSource oauth2.TokenSource, useMetadataServer bool, monitoringProject string) (*GCECloud, error) {
 
 	// Determine if cluster is on shared VPC network
 	// Must assert that the IDs are the same type (ID or number) before checking inequality
 	onXPN := isProjectNumber(projectID) == isProjectNumber(networkProjectID) && projectID != networkProjectID
 
+	operationPollRateLimiter := flowcontrol.NewTokenBucketRateLimiter(10, 100) // 10 qps, 100 bucket size.
+
+	// Resolve the default TokenSource here, before wrapping, so the wrapper
+	// always has a real base to refresh; newOauthClient's own nil handling
+	// is therefore never reached from here.
+	if tokenSource == nil {
+		var err error
+		tokenSource, err = google.DefaultTokenSource(
+			oauth2.NoContext,
+			compute.CloudPlatformScope,
+			compute.ComputeScope)
+		if err != nil {
+			return nil, err
+		}
+		glog.Infof("Using DefaultTokenSource %#v", tokenSource)
+	} else {
+		glog.Infof("Using existing Token Source %#v", tokenSource)
+	}
+
+	// Wrap the resolved TokenSource with a refresher that proactively renews
+	// the token in the background, and that backs off exponentially on its
+	// own on repeated failures instead of hammering the compute API with
+	// 429s (and without dipping into operationPollRateLimiter's budget).
+	refreshingTokenSource := NewRefreshingTokenSource(tokenSource)
+	refreshingTokenSource.Start()
+	tokenSource = refreshingTokenSource
+
 	client, err := newOauthClient(tokenSource)
 	if err != nil {
 		return nil, err
@@ -293,8 +410,23 @@ func CreateGCECloud(apiEndpoint, projectID, networkProjectID, region, zone strin
 		return nil, err
 	}
 
+	cloudsqlService, err := sqladmin.New(client)
+	if err != nil {
+		return nil, err
+	}
+
+	var metricsSink *StackdriverMetricsSink
+	if monitoringProject != "" {
+		metricsSink, err = NewStackdriverMetricsSink(client, monitoringProject)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var zoneLister *ZoneLister
 	if len(managedZones) == 0 {
-		managedZones, err = getZonesForRegion(service, projectID, region)
+		zoneLister = NewZoneLister(service, projectID, region, 0 /* defaultZoneListTTL */)
+		managedZones, err = zoneLister.list()
 		if err != nil {
 			return nil, err
 		}
@@ -303,13 +435,12 @@ func CreateGCECloud(apiEndpoint, projectID, networkProjectID, region, zone strin
 		glog.Infof("managing multiple zones: %v", managedZones)
 	}
 
-	operationPollRateLimiter := flowcontrol.NewTokenBucketRateLimiter(10, 100) // 10 qps, 100 bucket size.
-
 	gce := &GCECloud{
 		service:                  service,
 		serviceBeta:              serviceBeta,
 		containerService:         containerService,
 		cloudkmsService:          cloudkmsService,
+		cloudsqlService:          cloudsqlService,
 		projectID:                projectID,
 		networkProjectID:         networkProjectID,
 		onXPN:                    onXPN,
@@ -322,6 +453,9 @@ func CreateGCECloud(apiEndpoint, projectID, networkProjectID, region, zone strin
 		nodeInstancePrefix:       nodeInstancePrefix,
 		useMetadataServer:        useMetadataServer,
 		operationPollRateLimiter: operationPollRateLimiter,
+		zoneLister:               zoneLister,
+		tokenSource:              refreshingTokenSource,
+		metricsSink:              metricsSink,
 	}
 
 	gce.manager = &GCEServiceManager{gce}
@@ -369,6 +503,17 @@ func (gce *GCECloud) Region() string {
 	return gce.region
 }
 
+// Healthy reports whether gce's underlying token source currently believes
+// it can mint valid tokens. Wire this into the cloudprovider's health
+// endpoint to detect a stalled metadata server or expired credentials before
+// every API call starts failing.
+func (gce *GCECloud) Healthy() bool {
+	if gce.tokenSource == nil {
+		return true
+	}
+	return gce.tokenSource.Healthy()
+}
+
 // ProjectID returns the project ID which owns the instances
 func (gce *GCECloud) ProjectID() string {
 	return gce.projectID
@@ -461,28 +606,6 @@ func getNetworkProjectAndNameViaMetadata() (string, string, error) {
 	return parts[1], parts[3], nil
 }
 
-func getZonesForRegion(svc *compute.Service, projectID, region string) ([]string, error) {
-	// TODO: use PageToken to list all not just the first 500
-	listCall := svc.Zones.List(projectID)
-
-	// Filtering by region doesn't seem to work
-	// (tested in https://cloud.google.com/compute/docs/reference/latest/zones/list)
-	// listCall = listCall.Filter("region eq " + region)
-
-	res, err := listCall.Do()
-	if err != nil {
-		return nil, fmt.Errorf("unexpected response listing zones: %v", err)
-	}
-	zones := []string{}
-	for _, zone := range res.Items {
-		regionName := lastComponent(zone.Region)
-		if regionName == region {
-			zones = append(zones, zone.Name)
-		}
-	}
-	return zones, nil
-}
-
 func newOauthClient(tokenSource oauth2.TokenSource) (*http.Client, error) {
 	if tokenSource == nil {
 		var err error
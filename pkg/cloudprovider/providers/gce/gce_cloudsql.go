@@ -0,0 +1,118 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gce
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// cloudSQLCacheTTL bounds how long a resolved (or negatively-cached)
+// Cloud SQL instance name is trusted before ResolveCloudSQLInstance
+// re-lists instances.
+const cloudSQLCacheTTL = 30 * time.Second
+
+// errCloudSQLInstanceNotFound and errCloudSQLInstanceNoExternalIP are cached
+// negatively so repeatedly misconfigured pods fail fast instead of issuing a
+// full Instances.List call on every lookup.
+var (
+	errCloudSQLInstanceNotFound     = fmt.Errorf("cloudsql instance not found")
+	errCloudSQLInstanceNoExternalIP = fmt.Errorf("cloudsql instance has no external IP")
+)
+
+// CloudSQLResolver is an optional interface, analogous to the other optional
+// cloudprovider interfaces (LoadBalancer, Instances, Zones, ...), that a
+// cloudprovider.Interface implementation can provide so callers such as the
+// kubelet's DNS layer can resolve a Cloud SQL instance shortname to its
+// GCE-native endpoint without requiring a sidecar proxy.
+type CloudSQLResolver interface {
+	// ResolveCloudSQLInstance resolves instanceName (matched case-insensitively
+	// against the Cloud SQL instance shortname) to its first external IP.
+	ResolveCloudSQLInstance(ctx context.Context, instanceName string) (string, error)
+}
+
+var _ CloudSQLResolver = (*GCECloud)(nil)
+
+type cloudSQLCacheEntry struct {
+	ip        string
+	err       error
+	fetchedAt time.Time
+}
+
+// ResolveCloudSQLInstance resolves instanceName (matched case-insensitively
+// against the Cloud SQL instance shortname, e.g. "myinst" for
+// "myinst.cloudsql") to the first external IP address of the matching
+// instance in gce.projectID. Results, including "not found" and "no
+// external IP" failures, are cached for cloudSQLCacheTTL under
+// sharedResourceLock.
+func (gce *GCECloud) ResolveCloudSQLInstance(ctx context.Context, instanceName string) (string, error) {
+	if gce.cloudsqlService == nil {
+		return "", fmt.Errorf("cloudsql resolution is not configured")
+	}
+
+	shortName := instanceName
+	if i := strings.IndexByte(shortName, '.'); i >= 0 {
+		shortName = shortName[:i]
+	}
+
+	gce.sharedResourceLock.Lock()
+	if entry, ok := gce.cloudSQLCache[shortName]; ok && time.Since(entry.fetchedAt) < cloudSQLCacheTTL {
+		gce.sharedResourceLock.Unlock()
+		return entry.ip, entry.err
+	}
+	gce.sharedResourceLock.Unlock()
+
+	ip, err := gce.lookupCloudSQLInstance(ctx, shortName)
+
+	// Only cache a success or one of the two known sentinel failures,
+	// "not found"/"no external IP" — both are properties of the instance
+	// itself and won't change until the TTL expires. A transient
+	// Instances.List error is not cached, so it doesn't poison resolution
+	// for every caller until the next TTL expiry.
+	if err == nil || err == errCloudSQLInstanceNotFound || err == errCloudSQLInstanceNoExternalIP {
+		gce.sharedResourceLock.Lock()
+		if gce.cloudSQLCache == nil {
+			gce.cloudSQLCache = make(map[string]cloudSQLCacheEntry)
+		}
+		gce.cloudSQLCache[shortName] = cloudSQLCacheEntry{ip: ip, err: err, fetchedAt: time.Now()}
+		gce.sharedResourceLock.Unlock()
+	}
+
+	return ip, err
+}
+
+func (gce *GCECloud) lookupCloudSQLInstance(ctx context.Context, shortName string) (string, error) {
+	list, err := gce.cloudsqlService.Instances.List(gce.projectID).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to list cloudsql instances: %v", err)
+	}
+
+	for _, instance := range list.Items {
+		if !strings.EqualFold(instance.Name, shortName) {
+			continue
+		}
+		for _, addr := range instance.IpAddresses {
+			if addr.Type == "PRIMARY" && addr.IpAddress != "" {
+				return addr.IpAddress, nil
+			}
+		}
+		return "", errCloudSQLInstanceNoExternalIP
+	}
+	return "", errCloudSQLInstanceNotFound
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gce
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// metricContext times a single GCE API operation (e.g. a zone/region/global
+// operation wait) and reports its latency and result once Observe is
+// called. Observations are exported to Stackdriver through gce.metricsSink;
+// when no sink is configured, Observe records nothing.
+type metricContext struct {
+	start     time.Time
+	operation string
+	zone      string
+	sink      *StackdriverMetricsSink
+}
+
+// newMetricContext starts timing an operation named "<prefix>_<request>" in
+// zone (may be "" for region/global operations), exported through gce's
+// configured metrics sink, if any.
+func (gce *GCECloud) newMetricContext(prefix, request, zone string) *metricContext {
+	return &metricContext{
+		start:     time.Now(),
+		operation: prefix + "_" + request,
+		zone:      zone,
+		sink:      gce.metricsSink,
+	}
+}
+
+// Observe records the operation's latency and result (err == nil is a
+// success). It always returns err unchanged, so call sites can write
+// `return mc.Observe(err)`.
+func (mc *metricContext) Observe(err error) error {
+	if mc.sink != nil {
+		mc.sink.RecordOperation(mc.operation, mc.zone, time.Since(mc.start), err)
+		if isRateLimitExceeded(err) {
+			mc.sink.RecordQuotaConsumed(mc.operation, mc.zone, 1)
+		}
+	}
+	return err
+}
+
+// isRateLimitExceeded reports whether err is a 403/rateLimitExceeded
+// response from the compute API, i.e. the operation was rejected because it
+// ran out of quota.
+func isRateLimitExceeded(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	if !ok || gerr.Code != http.StatusForbidden {
+		return false
+	}
+	for _, e := range gerr.Errors {
+		if e.Reason == "rateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForZoneOp polls the given zonal operation until it reports DONE (or
+// operationPollTimeoutDuration elapses), pacing itself with
+// operationPollRateLimiter so a flaky API doesn't get hammered.
+func (gce *GCECloud) waitForZoneOp(op *compute.Operation, zone string, mc *metricContext) error {
+	return mc.Observe(wait.Poll(operationPollInterval, operationPollTimeoutDuration, func() (bool, error) {
+		if err := gce.operationPollRateLimiter.Accept(); err != nil {
+			return false, err
+		}
+		pollOp, err := gce.service.ZoneOperations.Get(gce.projectID, zone, op.Name).Do()
+		if err != nil {
+			return false, err
+		}
+		return opIsDone(pollOp)
+	}))
+}
+
+func opIsDone(op *compute.Operation) (bool, error) {
+	if op == nil || op.Status != "DONE" {
+		return false, nil
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return true, fmt.Errorf("operation %s failed: %+v", op.Name, op.Error.Errors[0])
+	}
+	return true, nil
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gce
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// serviceAccountJSONEnvVar, when set, is used as a fallback for
+// Config.Global.ServiceAccountJSONKeyFile so that off-cluster control planes
+// (e.g. a bastion host with no metadata server) can be pointed at a
+// service-account key file without editing the cloud config.
+const serviceAccountJSONEnvVar = "GCE_SERVICE_ACCOUNT_JSON"
+
+// defaultServiceAccountScopes are requested when Config.Global.ServiceAccountScopes
+// is left empty.
+var defaultServiceAccountScopes = []string{compute.CloudPlatformScope}
+
+// serviceAccountKeyFileFromEnv returns the service-account JSON key file path
+// set via GCE_SERVICE_ACCOUNT_JSON, or "" if unset.
+func serviceAccountKeyFileFromEnv() string {
+	return os.Getenv(serviceAccountJSONEnvVar)
+}
+
+// serviceAccountTokenSource builds an oauth2.TokenSource from a Google
+// service-account JSON key file, scoped to the given scopes (or
+// defaultServiceAccountScopes if none are given).
+func serviceAccountTokenSource(keyFile string, scopes []string) (oauth2.TokenSource, error) {
+	if len(scopes) == 0 {
+		scopes = defaultServiceAccountScopes
+	}
+
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service-account-key-file: %v", err)
+	}
+
+	jwtConfig, err := google.JWTConfigFromJSON(data, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse service-account-key-file: %v", err)
+	}
+
+	return jwtConfig.TokenSource(oauth2.NoContext), nil
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gce
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+const (
+	metricDomain = "custom.googleapis.com/k8s/gce_cloudprovider"
+
+	// flushInterval matches GCM's one-point-per-minute-per-timeseries rule:
+	// buffering any more often than this would just get points rejected.
+	flushInterval = time.Minute
+)
+
+// metricDescriptor is the minimal bookkeeping StackdriverMetricsSink needs
+// per custom metric: its GCM type name and whether Create has already run.
+type metricDescriptor struct {
+	metricType string
+	valueType  string
+	kind       string
+}
+
+// StackdriverMetricsSink exports cloudprovider operation metrics
+// (op_latency_seconds, op_errors_total, api_quota_consumed) to Cloud
+// Monitoring (Stackdriver), described lazily on first use and batched into
+// one TimeSeries.Create call per flushInterval, holding at most one point per
+// time series, to respect GCM's one-point-per-minute-per-timeseries limit.
+type StackdriverMetricsSink struct {
+	service   *monitoring.Service
+	projectID string
+
+	// startTime anchors the StartTime of every CUMULATIVE series this sink
+	// writes (op_errors_total, api_quota_consumed). GCM requires a
+	// CUMULATIVE point's StartTime to precede its EndTime and, conventionally,
+	// to stay fixed for the lifetime of the series.
+	startTime time.Time
+
+	mu              sync.Mutex
+	exportedMetrics map[string]metricDescriptor
+	pending         map[string]*monitoring.TimeSeries
+	// totals holds the running sum for each CUMULATIVE series (keyed the
+	// same way as pending), since GCM expects a CUMULATIVE point to carry
+	// the total accumulated since startTime, not the latest delta.
+	totals map[string]float64
+
+	stopCh chan struct{}
+}
+
+// NewStackdriverMetricsSink constructs a sink that writes into projectID
+// using client, and starts its background flush loop.
+func NewStackdriverMetricsSink(client *http.Client, projectID string) (*StackdriverMetricsSink, error) {
+	service, err := monitoring.New(client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Stackdriver monitoring client: %v", err)
+	}
+
+	sink := &StackdriverMetricsSink{
+		service:   service,
+		projectID: projectID,
+		// Back-dated slightly so the very first CUMULATIVE point, even if
+		// recorded immediately, has EndTime strictly after StartTime.
+		startTime:       time.Now().Add(-time.Second),
+		exportedMetrics: make(map[string]metricDescriptor),
+		pending:         make(map[string]*monitoring.TimeSeries),
+		totals:          make(map[string]float64),
+		stopCh:          make(chan struct{}),
+	}
+	go sink.flushLoop()
+	return sink, nil
+}
+
+// Stop terminates the background flush loop.
+func (s *StackdriverMetricsSink) Stop() {
+	close(s.stopCh)
+}
+
+// RecordOperation records one GCE API operation's latency and result,
+// buffering it for the next flush. result is "success" or "error". Each
+// error increments the op_errors_total running total for {operation, zone,
+// result} rather than resetting it, so GCM can compute a meaningful rate.
+func (s *StackdriverMetricsSink) RecordOperation(operation, zone string, latency time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+
+	s.record("op_latency_seconds", "DOUBLE", "GAUGE", operation, zone, result, latency.Seconds())
+	if err != nil {
+		s.record("op_errors_total", "INT64", "CUMULATIVE", operation, zone, result, 1)
+	}
+}
+
+// RecordQuotaConsumed adds units to the running api_quota_consumed total for
+// operation in zone, e.g. from a 403/rateLimitExceeded response's quota
+// info.
+func (s *StackdriverMetricsSink) RecordQuotaConsumed(operation, zone string, units float64) {
+	s.record("api_quota_consumed", "DOUBLE", "CUMULATIVE", operation, zone, "", units)
+}
+
+// record buffers one observation for the next flush. For GAUGE metrics,
+// value is reported as-is; for CUMULATIVE metrics, value is a delta added
+// to the series' running total (tracked in s.totals) and the new total is
+// what's actually reported, since GCM expects CUMULATIVE points to carry
+// the accumulated sum since startTime rather than the latest delta.
+func (s *StackdriverMetricsSink) record(metricName, valueType, kind, operation, zone, result string, value float64) {
+	if err := s.ensureDescriptor(metricName, valueType, kind); err != nil {
+		glog.Errorf("Stackdriver: failed to ensure descriptor for %s: %v", metricName, err)
+		return
+	}
+
+	labels := map[string]string{"operation": operation, "zone": zone}
+	if result != "" {
+		labels["result"] = result
+	}
+
+	interval := &monitoring.TimeInterval{EndTime: time.Now().UTC().Format(time.RFC3339)}
+	if kind == "CUMULATIVE" {
+		// CUMULATIVE series must report a StartTime before EndTime; GCM
+		// rejects the write otherwise.
+		interval.StartTime = s.startTime.UTC().Format(time.RFC3339)
+	}
+
+	key := metricName + "|" + operation + "|" + zone + "|" + result
+
+	s.mu.Lock()
+	reported := value
+	if kind == "CUMULATIVE" {
+		s.totals[key] += value
+		reported = s.totals[key]
+	}
+
+	typedValue := &monitoring.TypedValue{}
+	if valueType == "INT64" {
+		intValue := int64(reported)
+		typedValue.Int64Value = &intValue
+	} else {
+		typedValue.DoubleValue = &reported
+	}
+
+	point := &monitoring.Point{
+		Interval: interval,
+		Value:    typedValue,
+	}
+
+	ts := &monitoring.TimeSeries{
+		Metric: &monitoring.Metric{
+			Type:   metricDomain + "/" + metricName,
+			Labels: labels,
+		},
+		Resource: &monitoring.MonitoredResource{Type: "global"},
+		Points:   []*monitoring.Point{point},
+	}
+
+	// Keyed by metric+labels so at most one point per timeseries is kept
+	// between flushes, matching GCM's 1-point-per-minute-per-timeseries rule;
+	// since reported is already the running total, overwriting (rather than
+	// summing) pending entries is correct.
+	s.pending[key] = ts
+	s.mu.Unlock()
+}
+
+func (s *StackdriverMetricsSink) ensureDescriptor(metricName, valueType, kind string) error {
+	s.mu.Lock()
+	_, exists := s.exportedMetrics[metricName]
+	s.mu.Unlock()
+	if exists {
+		return nil
+	}
+
+	metricType := metricDomain + "/" + metricName
+	_, err := s.service.Projects.MetricDescriptors.Create("projects/"+s.projectID, &monitoring.MetricDescriptor{
+		Type:       metricType,
+		MetricKind: kind,
+		ValueType:  valueType,
+		Name:       metricType,
+		Description: fmt.Sprintf(
+			"GCE cloudprovider %s, exported by the Kubernetes GCE cloud provider.", metricName),
+	}).Do()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.exportedMetrics[metricName] = metricDescriptor{metricType: metricType, valueType: valueType, kind: kind}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *StackdriverMetricsSink) flushLoop() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+func (s *StackdriverMetricsSink) flush() {
+	s.mu.Lock()
+	if len(s.pending) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	timeSeries := make([]*monitoring.TimeSeries, 0, len(s.pending))
+	for _, ts := range s.pending {
+		timeSeries = append(timeSeries, ts)
+	}
+	s.pending = make(map[string]*monitoring.TimeSeries)
+	s.mu.Unlock()
+
+	req := &monitoring.CreateTimeSeriesRequest{TimeSeries: timeSeries}
+	if _, err := s.service.Projects.TimeSeries.Create("projects/"+s.projectID, req).Do(); err != nil {
+		glog.Errorf("Stackdriver: failed to write %d time series: %v", len(timeSeries), err)
+	}
+}
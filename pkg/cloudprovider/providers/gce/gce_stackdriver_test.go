@@ -0,0 +1,169 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gce
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+// newTestStackdriverSink returns a StackdriverMetricsSink pointed at a fake
+// Stackdriver API server that accepts MetricDescriptors.Create and
+// TimeSeries.Create calls without error. The returned sink has no background
+// flush loop running, so tests can call flush() deterministically.
+func newTestStackdriverSink(t *testing.T) *StackdriverMetricsSink {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := monitoring.New(server.Client())
+	if err != nil {
+		t.Fatalf("monitoring.New: %v", err)
+	}
+	service.BasePath = server.URL + "/"
+
+	sink := &StackdriverMetricsSink{
+		service:         service,
+		projectID:       "test-project",
+		startTime:       time.Now().Add(-time.Second),
+		exportedMetrics: make(map[string]metricDescriptor),
+		pending:         make(map[string]*monitoring.TimeSeries),
+		totals:          make(map[string]float64),
+		stopCh:          make(chan struct{}),
+	}
+	t.Cleanup(sink.Stop)
+	return sink
+}
+
+func TestRecordOperationUsesInt64ForCumulativeErrorCount(t *testing.T) {
+	sink := newTestStackdriverSink(t)
+	sink.RecordOperation("insert", "us-central1-a", time.Millisecond, errCloudSQLInstanceNotFound)
+
+	ts := sink.pending["op_errors_total|insert|us-central1-a|error"]
+	if ts == nil {
+		t.Fatal("expected an op_errors_total series to be pending")
+	}
+	point := ts.Points[0]
+	if point.Value.Int64Value == nil {
+		t.Fatalf("op_errors_total point should carry Int64Value, got %+v", point.Value)
+	}
+	if point.Value.DoubleValue != nil {
+		t.Fatalf("op_errors_total point should not carry DoubleValue, got %v", *point.Value.DoubleValue)
+	}
+	if *point.Value.Int64Value != 1 {
+		t.Fatalf("expected running total 1, got %d", *point.Value.Int64Value)
+	}
+	if point.Interval.StartTime == "" {
+		t.Fatal("expected CUMULATIVE point to carry a StartTime")
+	}
+}
+
+func TestRecordOperationAccumulatesCumulativeTotal(t *testing.T) {
+	sink := newTestStackdriverSink(t)
+
+	const errorCount = 5
+	for i := 0; i < errorCount; i++ {
+		sink.RecordOperation("insert", "us-central1-a", time.Millisecond, errCloudSQLInstanceNotFound)
+	}
+
+	// All errorCount observations land on the same series within one flush
+	// window, so there must be exactly one pending point carrying the
+	// accumulated running total, not errorCount separate value-1 points.
+	ts := sink.pending["op_errors_total|insert|us-central1-a|error"]
+	if ts == nil {
+		t.Fatal("expected an op_errors_total series to be pending")
+	}
+	if len(ts.Points) != 1 {
+		t.Fatalf("expected exactly one buffered point, got %d", len(ts.Points))
+	}
+	if got := *ts.Points[0].Value.Int64Value; got != errorCount {
+		t.Fatalf("expected running total %d after %d errors, got %d", errorCount, errorCount, got)
+	}
+}
+
+func TestRecordOperationSuccessDoesNotEmitErrorSeries(t *testing.T) {
+	sink := newTestStackdriverSink(t)
+	sink.RecordOperation("insert", "us-central1-a", time.Millisecond, nil)
+
+	if _, ok := sink.pending["op_errors_total|insert|us-central1-a|success"]; ok {
+		t.Fatal("a successful operation should not buffer an op_errors_total point")
+	}
+	if _, ok := sink.pending["op_latency_seconds|insert|us-central1-a|success"]; !ok {
+		t.Fatal("expected an op_latency_seconds point for the successful operation")
+	}
+}
+
+func TestRecordQuotaConsumedAccumulates(t *testing.T) {
+	sink := newTestStackdriverSink(t)
+	sink.RecordQuotaConsumed("list", "us-central1-a", 3)
+	sink.RecordQuotaConsumed("list", "us-central1-a", 4)
+
+	ts := sink.pending["api_quota_consumed|list|us-central1-a|"]
+	if ts == nil {
+		t.Fatal("expected an api_quota_consumed series to be pending")
+	}
+	if got := *ts.Points[0].Value.DoubleValue; got != 7 {
+		t.Fatalf("expected accumulated quota 7, got %v", got)
+	}
+}
+
+func TestFlushClearsPendingAndPostsTimeSeries(t *testing.T) {
+	var posted monitoring.CreateTimeSeriesRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path != "" {
+			_ = json.NewDecoder(r.Body).Decode(&posted)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	service, err := monitoring.New(server.Client())
+	if err != nil {
+		t.Fatalf("monitoring.New: %v", err)
+	}
+	service.BasePath = server.URL + "/"
+
+	sink := &StackdriverMetricsSink{
+		service:         service,
+		projectID:       "test-project",
+		startTime:       time.Now().Add(-time.Second),
+		exportedMetrics: make(map[string]metricDescriptor),
+		pending:         make(map[string]*monitoring.TimeSeries),
+		totals:          make(map[string]float64),
+		stopCh:          make(chan struct{}),
+	}
+
+	sink.RecordOperation("insert", "us-central1-a", time.Millisecond, nil)
+	sink.flush()
+
+	if len(sink.pending) != 0 {
+		t.Fatalf("expected pending to be cleared after flush, got %d entries", len(sink.pending))
+	}
+	if len(posted.TimeSeries) != 1 {
+		t.Fatalf("expected exactly one time series to be posted, got %d", len(posted.TimeSeries))
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gce
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/oauth2"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// refreshBeforeExpiry is how far ahead of a token's expiry the
+	// background refresher tries to renew it.
+	refreshBeforeExpiry = 5 * time.Minute
+
+	// minRefreshInterval bounds how often the refresher wakes up, so a token
+	// with no expiry (or a bogus one) doesn't spin the refresh loop.
+	minRefreshInterval = 30 * time.Second
+)
+
+// initialRefreshBackoff is the starting point for the exponential backoff
+// applied between refresh retries after a failure; it resets on the next
+// successful refresh. Using its own backoff (rather than the shared
+// operationPollRateLimiter) keeps a run of token failures from eating into
+// the budget operation polling needs for its own retries.
+func initialRefreshBackoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: minRefreshInterval,
+		Factor:   2,
+		Jitter:   0.1,
+		Cap:      10 * time.Minute,
+		Steps:    8,
+	}
+}
+
+// ExternalTokenSourceProvider, if non-nil, is consulted by newGCECloud (when
+// a cloud config is given) before falling back to
+// service-account-key-file/TokenURL/ComputeTokenSource. It
+// lets operators plug in token sources that can't be expressed in the gcfg
+// config file, such as workload-identity federation or another
+// externally-managed oauth2.TokenSource. Callers driving CreateGCECloud
+// directly can simply pass their TokenSource of choice instead.
+var ExternalTokenSourceProvider func(cfg *Config) (oauth2.TokenSource, error)
+
+// RefreshingTokenSource wraps an oauth2.TokenSource with a background
+// goroutine that proactively refreshes the token ahead of its expiry,
+// instead of relying on the wrapped source's lazy, on-demand refresh. This
+// keeps long-lived controllers from stalling for minutes the first time they
+// make a call after the metadata server hiccups.
+type RefreshingTokenSource struct {
+	base oauth2.TokenSource
+
+	mu      sync.Mutex
+	current *oauth2.Token
+	healthy bool
+	backoff wait.Backoff
+
+	stopCh chan struct{}
+	once   sync.Once
+}
+
+// NewRefreshingTokenSource returns a RefreshingTokenSource wrapping base.
+func NewRefreshingTokenSource(base oauth2.TokenSource) *RefreshingTokenSource {
+	return &RefreshingTokenSource{
+		base:    base,
+		backoff: initialRefreshBackoff(),
+		stopCh:  make(chan struct{}),
+	}
+}
+
+// Start launches the background refresh goroutine. Calling Start more than
+// once is a no-op.
+func (r *RefreshingTokenSource) Start() {
+	r.once.Do(func() {
+		go r.run()
+	})
+}
+
+// Stop terminates the background refresh goroutine.
+func (r *RefreshingTokenSource) Stop() {
+	close(r.stopCh)
+}
+
+// Token implements oauth2.TokenSource. It returns the most recently
+// refreshed token if one is cached and still valid, falling back to the
+// wrapped source otherwise (e.g. before the first background refresh has
+// completed).
+func (r *RefreshingTokenSource) Token() (*oauth2.Token, error) {
+	r.mu.Lock()
+	tok := r.current
+	r.mu.Unlock()
+
+	if tok != nil && tok.Valid() {
+		return tok, nil
+	}
+	return r.refresh()
+}
+
+// Healthy reports whether the most recent refresh attempt succeeded.
+func (r *RefreshingTokenSource) Healthy() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.healthy
+}
+
+func (r *RefreshingTokenSource) refresh() (*oauth2.Token, error) {
+	if r.base == nil {
+		return nil, fmt.Errorf("RefreshingTokenSource has no base TokenSource")
+	}
+	tok, err := r.base.Token()
+
+	r.mu.Lock()
+	r.healthy = err == nil
+	if err == nil {
+		r.current = tok
+		r.backoff = initialRefreshBackoff()
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		glog.Errorf("Failed to refresh GCE oauth token: %v", err)
+	}
+	return tok, err
+}
+
+func (r *RefreshingTokenSource) run() {
+	for {
+		nextWait := minRefreshInterval
+		if tok, err := r.refresh(); err != nil {
+			nextWait = r.nextBackoff()
+		} else if !tok.Expiry.IsZero() {
+			if d := time.Until(tok.Expiry) - refreshBeforeExpiry; d > minRefreshInterval {
+				nextWait = d
+			}
+		}
+
+		select {
+		case <-time.After(nextWait):
+		case <-r.stopCh:
+			return
+		}
+	}
+}
+
+// nextBackoff returns, and advances, the exponential backoff applied after a
+// failed refresh. It resets to its initial value on the next success (see
+// refresh).
+func (r *RefreshingTokenSource) nextBackoff() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.backoff.Step()
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gce
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeTokenSource returns the errors in errs on Token(), one per call
+// (consuming them), and returns tok once errs is empty.
+// Every call is recorded so tests can assert on call count.
+type fakeTokenSource struct {
+	tok   *oauth2.Token
+	errs  []error
+	calls int
+}
+
+func (f *fakeTokenSource) Token() (*oauth2.Token, error) {
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+	return f.tok, nil
+}
+
+func TestRefreshSucceedsAndMarksHealthy(t *testing.T) {
+	base := &fakeTokenSource{tok: &oauth2.Token{AccessToken: "abc"}}
+	rts := NewRefreshingTokenSource(base)
+
+	tok, err := rts.refresh()
+	if err != nil {
+		t.Fatalf("refresh() returned error: %v", err)
+	}
+	if tok.AccessToken != "abc" {
+		t.Fatalf("expected token %q, got %q", "abc", tok.AccessToken)
+	}
+	if !rts.Healthy() {
+		t.Fatal("expected Healthy() to be true after a successful refresh")
+	}
+}
+
+func TestRefreshFailureMarksUnhealthyAndAdvancesBackoff(t *testing.T) {
+	base := &fakeTokenSource{errs: []error{fmt.Errorf("metadata server unreachable")}}
+	rts := NewRefreshingTokenSource(base)
+
+	if _, err := rts.refresh(); err == nil {
+		t.Fatal("expected refresh() to return the base TokenSource's error")
+	}
+	if rts.Healthy() {
+		t.Fatal("expected Healthy() to be false after a failed refresh")
+	}
+
+	first := rts.nextBackoff()
+	second := rts.nextBackoff()
+	if second <= first {
+		t.Fatalf("expected backoff to increase across failures, got %v then %v", first, second)
+	}
+}
+
+func TestRefreshResetsBackoffAfterSuccess(t *testing.T) {
+	base := &fakeTokenSource{
+		tok:  &oauth2.Token{AccessToken: "abc"},
+		errs: []error{fmt.Errorf("transient failure")},
+	}
+	rts := NewRefreshingTokenSource(base)
+
+	if _, err := rts.refresh(); err == nil {
+		t.Fatal("expected the first refresh to fail")
+	}
+	// The first step returns the initial interval; the second one has grown.
+	rts.nextBackoff()
+	failedBackoff := rts.nextBackoff()
+
+	if _, err := rts.refresh(); err != nil {
+		t.Fatalf("expected the second refresh to succeed, got: %v", err)
+	}
+
+	resetBackoff := rts.nextBackoff()
+	if resetBackoff >= failedBackoff {
+		t.Fatalf("expected backoff to reset to its initial value after a success, got %v (was %v before reset)", resetBackoff, failedBackoff)
+	}
+}
+
+func TestRefreshWithNilBaseReturnsErrorInsteadOfPanicking(t *testing.T) {
+	rts := NewRefreshingTokenSource(nil)
+
+	if _, err := rts.refresh(); err == nil {
+		t.Fatal("expected refresh() with a nil base TokenSource to return an error")
+	}
+	if rts.Healthy() {
+		t.Fatal("expected Healthy() to stay false when there is no base TokenSource")
+	}
+}
+
+func TestTokenReturnsCachedTokenWithoutRefreshingWhenStillValid(t *testing.T) {
+	base := &fakeTokenSource{tok: &oauth2.Token{AccessToken: "abc"}}
+	rts := NewRefreshingTokenSource(base)
+
+	if _, err := rts.refresh(); err != nil {
+		t.Fatalf("refresh() returned error: %v", err)
+	}
+	rts.current.Expiry = time.Now().Add(time.Hour)
+
+	if _, err := rts.Token(); err != nil {
+		t.Fatalf("Token() returned error: %v", err)
+	}
+	if base.calls != 1 {
+		t.Fatalf("expected Token() to reuse the cached token without calling the base source again, got %d calls", base.calls)
+	}
+}
+
+func TestTokenRefreshesWhenCachedTokenIsExpired(t *testing.T) {
+	base := &fakeTokenSource{tok: &oauth2.Token{AccessToken: "abc"}}
+	rts := NewRefreshingTokenSource(base)
+
+	rts.mu.Lock()
+	rts.current = &oauth2.Token{AccessToken: "stale", Expiry: time.Now().Add(-time.Hour)}
+	rts.mu.Unlock()
+
+	tok, err := rts.Token()
+	if err != nil {
+		t.Fatalf("Token() returned error: %v", err)
+	}
+	if tok.AccessToken != "abc" {
+		t.Fatalf("expected Token() to refresh and return the new token, got %q", tok.AccessToken)
+	}
+	if base.calls != 1 {
+		t.Fatalf("expected exactly one refresh call, got %d", base.calls)
+	}
+}
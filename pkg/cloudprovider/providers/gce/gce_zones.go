@@ -0,0 +1,299 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gce
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// defaultZoneListTTL is how long a ZoneLister's cached zone list is
+	// considered fresh before the next ForEachZone/managed-zone refresh
+	// re-lists from the Zones API.
+	defaultZoneListTTL = 5 * time.Minute
+
+	// maxZoneFanOut bounds how many zones ForEachZone will scan concurrently,
+	// so a region with many zones doesn't open an unbounded number of
+	// connections to the compute API at once.
+	maxZoneFanOut = 5
+)
+
+// ZoneLister lists the zones of a region, paginating through the Zones API
+// and caching the result for ttl. It is safe for concurrent use.
+type ZoneLister struct {
+	service   *compute.Service
+	projectID string
+	region    string
+	ttl       time.Duration
+
+	mu          sync.Mutex
+	zones       []string
+	lastFetched time.Time
+}
+
+// NewZoneLister returns a ZoneLister for the given region. A ttl <= 0 uses
+// defaultZoneListTTL.
+func NewZoneLister(service *compute.Service, projectID, region string, ttl time.Duration) *ZoneLister {
+	if ttl <= 0 {
+		ttl = defaultZoneListTTL
+	}
+	return &ZoneLister{
+		service:   service,
+		projectID: projectID,
+		region:    region,
+		ttl:       ttl,
+	}
+}
+
+// list returns the cached zone list, refreshing it first if it is older than
+// the ZoneLister's ttl.
+func (z *ZoneLister) list() ([]string, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if z.zones != nil && time.Since(z.lastFetched) < z.ttl {
+		return z.zones, nil
+	}
+
+	zones, err := listZonesForRegionPaginated(z.service, z.projectID, z.region)
+	if err != nil {
+		// Serve stale data rather than fail outright if we have it.
+		if z.zones != nil {
+			glog.Warningf("Failed to refresh zone list for region %q, using stale cache: %v", z.region, err)
+			return z.zones, nil
+		}
+		return nil, err
+	}
+
+	z.zones = zones
+	z.lastFetched = time.Now()
+	return z.zones, nil
+}
+
+// listZonesForRegionPaginated pages through Zones.List (capped at maxPages
+// pages) and returns the zone names belonging to region.
+func listZonesForRegionPaginated(svc *compute.Service, projectID, region string) ([]string, error) {
+	zones := []string{}
+	listCall := svc.Zones.List(projectID)
+
+	for page := 0; page < maxPages; page++ {
+		res, err := listCall.Do()
+		if err != nil {
+			return nil, fmt.Errorf("unexpected response listing zones: %v", err)
+		}
+		for _, zone := range res.Items {
+			if lastComponent(zone.Region) == region {
+				zones = append(zones, zone.Name)
+			}
+		}
+		if res.NextPageToken == "" {
+			break
+		}
+		listCall = svc.Zones.List(projectID).PageToken(res.NextPageToken)
+	}
+
+	return zones, nil
+}
+
+// refreshManagedZones re-lists the managed zones for gce.region via its
+// ZoneLister, updates gce.managedZones, and returns the zones it fetched —
+// all serialized under sharedResourceLock like other state-mutating GCE
+// operations, so callers must use the returned slice rather than re-reading
+// gce.managedZones unlocked afterward. It is a no-op read of the existing
+// value for single-zone (non-multizone) clusters, which have no ZoneLister.
+func (gce *GCECloud) refreshManagedZones() ([]string, error) {
+	gce.sharedResourceLock.Lock()
+	defer gce.sharedResourceLock.Unlock()
+
+	if gce.zoneLister == nil {
+		return gce.managedZones, nil
+	}
+
+	zones, err := gce.zoneLister.list()
+	if err != nil {
+		return nil, err
+	}
+	gce.managedZones = zones
+	return zones, nil
+}
+
+// ForEachZone calls fn once per managed zone, fanning the calls out across a
+// bounded worker pool (maxZoneFanOut at a time). If any call returns an
+// error, ctx is canceled so calls that have not started yet are skipped, and
+// ForEachZone returns the first error observed. Calls already running are
+// not interrupted: fn does not receive ctx.
+func (gce *GCECloud) ForEachZone(ctx context.Context, fn func(zone string) error) error {
+	zones, err := gce.refreshManagedZones()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sem := make(chan struct{}, maxZoneFanOut)
+	errCh := make(chan error, len(zones))
+	var wg sync.WaitGroup
+
+	for _, zone := range zones {
+		wg.Add(1)
+		go func(zone string) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				errCh <- ctx.Err()
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				errCh <- ctx.Err()
+				return
+			default:
+			}
+
+			if err := fn(zone); err != nil {
+				errCh <- fmt.Errorf("zone %q: %v", zone, err)
+				cancel()
+			}
+		}(zone)
+	}
+
+	wg.Wait()
+	close(errCh)
+
+	var firstErr error
+	for err := range errCh {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// GetDiskAnyZone finds the persistent disk named diskName in whichever of
+// gce's managed zones it lives in, fanning the per-zone Disks.Get calls out
+// through ForEachZone instead of scanning zones one at a time. It returns
+// the disk and the zone it was found in.
+func (gce *GCECloud) GetDiskAnyZone(ctx context.Context, diskName string) (*compute.Disk, string, error) {
+	var (
+		mu        sync.Mutex
+		found     *compute.Disk
+		foundZone string
+	)
+
+	err := gce.ForEachZone(ctx, func(zone string) error {
+		disk, err := gce.manager.GetDisk(gce.projectID, zone, diskName)
+		if err != nil {
+			if isHTTPNotFound(err) {
+				return nil
+			}
+			return err
+		}
+
+		mu.Lock()
+		found, foundZone = disk, zone
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if found == nil {
+		return nil, "", fmt.Errorf("disk %q not found in any managed zone", diskName)
+	}
+	return found, foundZone, nil
+}
+
+// GetInstanceAnyZone finds the Instance named instanceName in whichever of
+// gce's managed zones it lives in, fanning the per-zone Instances.Get calls
+// out through ForEachZone instead of scanning zones one at a time. This is
+// the Instances-side analogue of GetDiskAnyZone, for callers (e.g. the
+// cloudprovider.Instances implementation) that only know a node's name.
+func (gce *GCECloud) GetInstanceAnyZone(ctx context.Context, instanceName string) (*compute.Instance, string, error) {
+	var (
+		mu        sync.Mutex
+		found     *compute.Instance
+		foundZone string
+	)
+
+	err := gce.ForEachZone(ctx, func(zone string) error {
+		instance, err := gce.service.Instances.Get(gce.projectID, zone, instanceName).Do()
+		if err != nil {
+			if isHTTPNotFound(err) {
+				return nil
+			}
+			return err
+		}
+
+		mu.Lock()
+		found, foundZone = instance, zone
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if found == nil {
+		return nil, "", fmt.Errorf("instance %q not found in any managed zone", instanceName)
+	}
+	return found, foundZone, nil
+}
+
+// ListManagedInstancesByZone lists every Instance in gce's managed zones,
+// grouped by zone, fanning the per-zone Instances.List calls out through
+// ForEachZone. It lets a LoadBalancer implementation discover which zone
+// each of a target pool's candidate nodes lives in when building or
+// reconciling target pools, instead of listing zones one at a time.
+func (gce *GCECloud) ListManagedInstancesByZone(ctx context.Context) (map[string][]*compute.Instance, error) {
+	var mu sync.Mutex
+	byZone := make(map[string][]*compute.Instance)
+
+	err := gce.ForEachZone(ctx, func(zone string) error {
+		list, err := gce.service.Instances.List(gce.projectID, zone).Do()
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		byZone[zone] = list.Items
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return byZone, nil
+}
+
+func isHTTPNotFound(err error) bool {
+	if gerr, ok := err.(*googleapi.Error); ok {
+		return gerr.Code == http.StatusNotFound
+	}
+	return false
+}